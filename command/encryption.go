@@ -0,0 +1,174 @@
+package command
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Metadata keys set on encrypted objects so a reader with the unwrapped key
+// (or the passphrase, for the scrypt path) can decrypt the archive again.
+const (
+	metaEncryption = "rover-encryption"
+	metaNonce      = "rover-nonce"
+	metaWrappedKey = "rover-wrapped-key"
+	metaKMSKeyID   = "rover-kms-key-id"
+	metaKDFSalt    = "rover-kdf-salt"
+
+	encryptionAlgorithm = "AES256-GCM"
+	kdfScrypt           = "scrypt"
+
+	// plainChunkSize is the amount of plaintext sealed under each GCM nonce.
+	// Vault/Consul dumps can be multiple GB, so the whole archive is never
+	// sealed as a single AEAD message.
+	plainChunkSize = 1 << 20 // 1MB
+)
+
+// envelopeKey is a per-upload AES-256 data key plus however it was wrapped,
+// ready to be stored alongside the encrypted object as metadata.
+type envelopeKey struct {
+	plaintext []byte            // never leaves the process; used locally to encrypt
+	metadata  map[string]string // wrapped key + KDF/KMS parameters to persist
+}
+
+// newKMSEnvelopeKey asks AWS KMS to generate a new data key and returns both
+// the plaintext key (used locally to encrypt) and the KMS-wrapped
+// ciphertext blob (safe to store next to the object).
+func newKMSEnvelopeKey(keyID string) (*envelopeKey, error) {
+	sess := session.New()
+	svc := kms.New(sess)
+	out, err := svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not generate KMS data key: %w", err)
+	}
+	return &envelopeKey{
+		plaintext: out.Plaintext,
+		metadata: map[string]string{
+			metaWrappedKey: base64.StdEncoding.EncodeToString(out.CiphertextBlob),
+			// out.KeyId is KMS's canonical key ARN, which resolves even if
+			// keyID was an alias; store that rather than echoing the input.
+			metaKMSKeyID: aws.StringValue(out.KeyId),
+		},
+	}, nil
+}
+
+// newPassphraseEnvelopeKey derives a data key from a passphrase via scrypt,
+// for offline use when there is no KMS to talk to. Only the salt is
+// persisted; the passphrase itself must be supplied again to decrypt.
+func newPassphraseEnvelopeKey(passphrase string) (*envelopeKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("could not generate KDF salt: %w", err)
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key from passphrase: %w", err)
+	}
+	return &envelopeKey{
+		plaintext: key,
+		metadata: map[string]string{
+			"rover-kdf": kdfScrypt,
+			metaKDFSalt: base64.StdEncoding.EncodeToString(salt),
+		},
+	}, nil
+}
+
+// gcmChunkReader wraps a plaintext io.Reader and emits AES-256-GCM
+// ciphertext, sealing the stream in fixed-size chunks so multi-GB archives
+// are never held in memory as a single AEAD message. Each chunk's nonce is
+// the random base nonce with its low 32 bits replaced by a counter, and the
+// final chunk is authenticated as final via its AAD so truncation is
+// detectable on decrypt.
+type gcmChunkReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	baseNonce []byte
+	counter   uint32
+	plain     []byte
+	out       []byte
+	eof       bool
+}
+
+func newGCMChunkReader(src io.Reader, key []byte) (*gcmChunkReader, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	baseNonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(baseNonce); err != nil {
+		return nil, nil, err
+	}
+	return &gcmChunkReader{
+		src:       src,
+		aead:      aead,
+		baseNonce: baseNonce,
+		plain:     make([]byte, plainChunkSize),
+	}, baseNonce, nil
+}
+
+func (g *gcmChunkReader) nonce(final bool) ([]byte, []byte) {
+	nonce := make([]byte, len(g.baseNonce))
+	copy(nonce, g.baseNonce)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], g.counter)
+	aad := []byte{0}
+	if final {
+		aad[0] = 1
+	}
+	return nonce, aad
+}
+
+func (g *gcmChunkReader) Read(p []byte) (int, error) {
+	for len(g.out) == 0 {
+		if g.eof {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(g.src, g.plain)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, err
+		}
+		final := err == io.ErrUnexpectedEOF || err == io.EOF
+		if final {
+			g.eof = true
+		}
+		nonce, aad := g.nonce(final)
+		g.out = g.aead.Seal(nil, nonce, g.plain[:n], aad)
+		g.counter++
+	}
+	n := copy(p, g.out)
+	g.out = g.out[n:]
+	return n, nil
+}
+
+// encryptReader wraps src in client-side envelope encryption and returns the
+// ciphertext reader plus the metadata to store on the uploaded object so it
+// can be decrypted later.
+func encryptReader(src io.Reader, ek *envelopeKey) (io.Reader, map[string]string, error) {
+	r, baseNonce, err := newGCMChunkReader(src, ek.plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start envelope encryption: %w", err)
+	}
+	meta := map[string]string{
+		metaEncryption: encryptionAlgorithm,
+		metaNonce:      base64.StdEncoding.EncodeToString(baseNonce),
+	}
+	for k, v := range ek.metadata {
+		meta[k] = v
+	}
+	return r, meta, nil
+}
@@ -0,0 +1,148 @@
+package command
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// decryptChunks reverses gcmChunkReader's framing: each chunk is sealed
+// under baseNonce with its low 32 bits replaced by an incrementing counter,
+// and AAD marks whether it's the final chunk. It's the inverse of the
+// scheme gcmChunkReader implements, used here to prove encryptReader
+// produces ciphertext that actually decrypts back to the original bytes.
+func decryptChunks(ciphertext, baseNonce, key []byte, chunkSize int) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sealedChunkSize := chunkSize + aead.Overhead()
+
+	var plaintext []byte
+	var counter uint32
+	for len(ciphertext) > 0 {
+		n := sealedChunkSize
+		final := len(ciphertext) <= sealedChunkSize
+		if final {
+			n = len(ciphertext)
+		}
+		chunk := ciphertext[:n]
+		ciphertext = ciphertext[n:]
+
+		nonce := make([]byte, len(baseNonce))
+		copy(nonce, baseNonce)
+		binary.BigEndian.PutUint32(nonce[len(nonce)-4:], counter)
+		aad := []byte{0}
+		if final {
+			aad[0] = 1
+		}
+		p, err := aead.Open(nil, nonce, chunk, aad)
+		if err != nil {
+			return nil, fmt.Errorf("open chunk %d: %w", counter, err)
+		}
+		plaintext = append(plaintext, p...)
+		counter++
+	}
+	return plaintext, nil
+}
+
+func TestEncryptReaderRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"smaller than one chunk", 1024},
+		{"exactly one chunk", plainChunkSize},
+		{"spans multiple chunks", plainChunkSize*2 + 512},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext := make([]byte, tc.size)
+			for i := range plaintext {
+				plaintext[i] = byte(i)
+			}
+
+			ek := &envelopeKey{plaintext: make([]byte, 32)}
+			r, meta, err := encryptReader(bytes.NewReader(plaintext), ek)
+			if err != nil {
+				t.Fatalf("encryptReader: %v", err)
+			}
+			if meta[metaEncryption] != encryptionAlgorithm {
+				t.Fatalf("metaEncryption = %q, want %q", meta[metaEncryption], encryptionAlgorithm)
+			}
+			baseNonce, err := base64.StdEncoding.DecodeString(meta[metaNonce])
+			if err != nil {
+				t.Fatalf("decode nonce: %v", err)
+			}
+			ciphertext, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read ciphertext: %v", err)
+			}
+
+			got, err := decryptChunks(ciphertext, baseNonce, ek.plaintext, plainChunkSize)
+			if err != nil {
+				t.Fatalf("decryptChunks: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("round-tripped plaintext does not match original (got %d bytes, want %d)", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestEncryptReaderDetectsTruncation(t *testing.T) {
+	plaintext := make([]byte, plainChunkSize+256)
+	ek := &envelopeKey{plaintext: make([]byte, 32)}
+	r, meta, err := encryptReader(bytes.NewReader(plaintext), ek)
+	if err != nil {
+		t.Fatalf("encryptReader: %v", err)
+	}
+	baseNonce, err := base64.StdEncoding.DecodeString(meta[metaNonce])
+	if err != nil {
+		t.Fatalf("decode nonce: %v", err)
+	}
+	ciphertext, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read ciphertext: %v", err)
+	}
+
+	block, _ := aes.NewCipher(ek.plaintext)
+	aead, _ := cipher.NewGCM(block)
+	sealedChunkSize := plainChunkSize + aead.Overhead()
+	truncated := ciphertext[:sealedChunkSize] // drop the final, shorter chunk
+
+	if _, err := decryptChunks(truncated, baseNonce, ek.plaintext, plainChunkSize); err == nil {
+		t.Fatalf("decryptChunks succeeded on a truncated stream, want an AEAD auth failure")
+	}
+}
+
+func TestNewPassphraseEnvelopeKeyUsesFreshSalt(t *testing.T) {
+	ek1, err := newPassphraseEnvelopeKey("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("newPassphraseEnvelopeKey: %v", err)
+	}
+	if len(ek1.plaintext) != 32 {
+		t.Fatalf("derived key length = %d, want 32", len(ek1.plaintext))
+	}
+	if ek1.metadata["rover-kdf"] != kdfScrypt {
+		t.Fatalf("rover-kdf = %q, want %q", ek1.metadata["rover-kdf"], kdfScrypt)
+	}
+	ek2, err := newPassphraseEnvelopeKey("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("newPassphraseEnvelopeKey: %v", err)
+	}
+	if bytes.Equal(ek1.plaintext, ek2.plaintext) {
+		t.Fatalf("two calls derived the same key despite independent random salts")
+	}
+}
@@ -0,0 +1,142 @@
+package command
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// manifestFile is where the post-upload manifest is written so rover can be
+// chained in CI pipelines that expect a fixed, discoverable path.
+const manifestFile = "rover-upload-manifest.json"
+
+// UploadManifest records everything a downstream consumer needs to locate,
+// verify, and fetch an uploaded archive without re-reading the object.
+type UploadManifest struct {
+	Provider        string `json:"provider"`
+	Bucket          string `json:"bucket,omitempty"`
+	Key             string `json:"key"`
+	Region          string `json:"region,omitempty"`
+	Location        string `json:"location"`
+	Size            int64  `json:"size"`
+	SHA256          string `json:"sha256"`
+	MultipartETag   string `json:"multipart_etag,omitempty"`
+	ETagVerified    bool   `json:"etag_verified"`
+	KMSKeyARN       string `json:"kms_key_arn,omitempty"`
+	PresignedURL    string `json:"presigned_url,omitempty"`
+	PresignedExpiry string `json:"presigned_url_expires_at,omitempty"`
+	UploadedAt      string `json:"uploaded_at"`
+}
+
+// writeManifest marshals m to manifestFile in the current directory.
+func writeManifest(m UploadManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal upload manifest: %w", err)
+	}
+	return os.WriteFile(manifestFile, b, 0644)
+}
+
+// multipartETagReader wraps an io.Reader and, as bytes pass through,
+// computes the same "md5-of-md5s" ETag S3 assigns to a multipart upload, so
+// the caller can verify the object landed intact without re-downloading it.
+type multipartETagReader struct {
+	src         io.Reader
+	partSize    int64
+	partHash    hash.Hash
+	partWritten int64
+	partSums    []byte
+	parts       int
+}
+
+func newMultipartETagReader(src io.Reader, partSize int64) *multipartETagReader {
+	return &multipartETagReader{src: src, partSize: partSize, partHash: md5.New()}
+}
+
+func (m *multipartETagReader) Read(p []byte) (int, error) {
+	n, err := m.src.Read(p)
+	if n > 0 {
+		m.consume(p[:n])
+	}
+	if err == io.EOF {
+		m.finish()
+	}
+	return n, err
+}
+
+func (m *multipartETagReader) consume(b []byte) {
+	for len(b) > 0 {
+		remaining := m.partSize - m.partWritten
+		take := int64(len(b))
+		if take > remaining {
+			take = remaining
+		}
+		m.partHash.Write(b[:take])
+		m.partWritten += take
+		b = b[take:]
+		if m.partWritten == m.partSize {
+			m.closePart()
+		}
+	}
+}
+
+func (m *multipartETagReader) closePart() {
+	m.partSums = append(m.partSums, m.partHash.Sum(nil)...)
+	m.parts++
+	m.partHash = md5.New()
+	m.partWritten = 0
+}
+
+// finish flushes a trailing partial part. Safe to call more than once.
+func (m *multipartETagReader) finish() {
+	if m.partWritten > 0 {
+		m.closePart()
+	}
+}
+
+// ETag returns the multipart ETag rover computed locally, formatted the way
+// S3 reports it (quoted, "-N" suffixed for true multipart objects).
+func (m *multipartETagReader) ETag() string {
+	m.finish()
+	switch m.parts {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("\"%x\"", m.partSums)
+	default:
+		sum := md5.Sum(m.partSums)
+		return fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(sum[:]), m.parts)
+	}
+}
+
+// multipartETagFromParts builds the same "md5-of-md5s" ETag S3 assigns a
+// multipart object, but from the per-part ETags UploadPart already
+// returned, rather than re-hashing the archive locally. S3 applies the
+// md5-of-md5s-plus-"-N" formula to every object completed via
+// CompleteMultipartUpload, including a single-part one (N=1) — it never
+// falls back to a bare per-part ETag for those, so there's no N==1 special
+// case here.
+func multipartETagFromParts(partETags []string) string {
+	if len(partETags) == 0 {
+		return ""
+	}
+	var sums []byte
+	for _, e := range partETags {
+		raw := strings.Trim(e, `"`)
+		b, err := hex.DecodeString(raw)
+		if err != nil {
+			// A part ETag that isn't a plain MD5 hex digest (e.g. SSE-C)
+			// can't be folded into the multipart math; report no ETag
+			// rather than a bogus combined one.
+			return ""
+		}
+		sums = append(sums, b...)
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(sum[:]), len(partETags))
+}
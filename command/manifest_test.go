@@ -0,0 +1,140 @@
+package command
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// s3ETag mirrors how S3 reports an object's ETag: a plain MD5 hex digest
+// for a single-part object, or md5-of-the-concatenated-part-MD5s plus a
+// "-N" part count suffix for a true multipart object.
+func s3ETag(parts ...[]byte) string {
+	if len(parts) == 1 {
+		sum := md5.Sum(parts[0])
+		return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+	}
+	var sums []byte
+	for _, p := range parts {
+		sum := md5.Sum(p)
+		sums = append(sums, sum[:]...)
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:])+fmt.Sprintf("-%d", len(parts)))
+}
+
+func TestMultipartETagReaderMatchesS3(t *testing.T) {
+	partSize := int64(8)
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"single partial part", bytes.Repeat([]byte("a"), 5)},
+		{"single full part", bytes.Repeat([]byte("b"), 8)},
+		{"two full parts", bytes.Repeat([]byte("c"), 16)},
+		{"two parts, trailing partial", bytes.Repeat([]byte("d"), 20)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newMultipartETagReader(bytes.NewReader(tc.data), partSize)
+			if _, err := ioutil.ReadAll(r); err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			got := r.ETag()
+
+			var want string
+			if len(tc.data) == 0 {
+				want = ""
+			} else {
+				var parts [][]byte
+				for i := 0; i < len(tc.data); i += int(partSize) {
+					end := i + int(partSize)
+					if end > len(tc.data) {
+						end = len(tc.data)
+					}
+					parts = append(parts, tc.data[i:end])
+				}
+				want = s3ETag(parts...)
+			}
+			if got != want {
+				t.Fatalf("ETag() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestMultipartETagFromPartsMatchesS3(t *testing.T) {
+	partA := bytes.Repeat([]byte("x"), 8)
+	partB := bytes.Repeat([]byte("y"), 8)
+	partC := bytes.Repeat([]byte("z"), 3)
+
+	etagOf := func(b []byte) string {
+		sum := md5.Sum(b)
+		return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+	}
+
+	t.Run("single part still applies the multipart md5-of-md5s formula", func(t *testing.T) {
+		// S3 formats the ETag of any object finished via
+		// CompleteMultipartUpload using the multipart formula, even when
+		// it only had one part — it never falls back to a bare PutObject
+		// ETag for those.
+		got := multipartETagFromParts([]string{etagOf(partA)})
+		partSum := md5.Sum(partA)
+		sum := md5.Sum(partSum[:])
+		want := fmt.Sprintf("%q", hex.EncodeToString(sum[:])+"-1")
+		if got != want {
+			t.Fatalf("multipartETagFromParts = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("multiple parts match S3's md5-of-md5s", func(t *testing.T) {
+		partETags := []string{etagOf(partA), etagOf(partB), etagOf(partC)}
+		got := multipartETagFromParts(partETags)
+		want := s3ETag(partA, partB, partC)
+		if got != want {
+			t.Fatalf("multipartETagFromParts = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("empty input", func(t *testing.T) {
+		if got := multipartETagFromParts(nil); got != "" {
+			t.Fatalf("multipartETagFromParts(nil) = %s, want empty", got)
+		}
+	})
+}
+
+func TestMultipartETagReaderAndFromPartsAgree(t *testing.T) {
+	// Both code paths (local hashing via multipartETagReader vs. folding
+	// together S3's own per-part ETags via multipartETagFromParts) derive
+	// the ETag for the same upload in different places; they must agree
+	// or post-upload verification would spuriously fail on the resumable
+	// path but not the non-resumable one, or vice versa.
+	partSize := int64(8)
+	data := bytes.Repeat([]byte("q"), 20)
+
+	r := newMultipartETagReader(bytes.NewReader(data), partSize)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	fromReader := r.ETag()
+
+	var partETags []string
+	for i := 0; i < len(data); i += int(partSize) {
+		end := i + int(partSize)
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[i:end])
+		partETags = append(partETags, fmt.Sprintf("%q", hex.EncodeToString(sum[:])))
+	}
+	fromParts := multipartETagFromParts(partETags)
+
+	if fromReader != fromParts {
+		t.Fatalf("multipartETagReader = %s, multipartETagFromParts = %s; want equal", fromReader, fromParts)
+	}
+}
@@ -0,0 +1,68 @@
+package command
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// uploadStateFile is the default name of the local resume record, mirroring
+// how rover drops its own rover.log next to the archive being handled.
+const uploadStateFile = ".rover-upload-state.json"
+
+// completedPart records one already-uploaded multipart part so a resumed
+// upload can skip re-sending it.
+type completedPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// uploadState is the on-disk record of an in-progress multipart upload. If
+// rover is interrupted mid-upload, a later run matching the same bucket,
+// key, and SHA-256 resumes by UploadID instead of restarting from byte
+// zero. PartSize (and NumParts, kept for easy inspection) are recorded so a
+// resume can detect a different -part-size being passed on the resuming run
+// instead of silently re-partitioning the stream against stale part offsets.
+type uploadState struct {
+	Bucket         string          `json:"bucket"`
+	Key            string          `json:"key"`
+	UploadID       string          `json:"upload_id"`
+	SHA256         string          `json:"sha256"`
+	PartSize       int64           `json:"part_size"`
+	NumParts       int64           `json:"num_parts"`
+	CompletedParts []completedPart `json:"completed_parts"`
+}
+
+// loadUploadState reads path, returning (nil, nil) if it does not exist.
+func loadUploadState(path string) (*uploadState, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st uploadState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// saveUploadState persists st to path so an interrupted upload can resume.
+func saveUploadState(path string, st *uploadState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// removeUploadState deletes path once an upload completes; a missing file
+// is not an error.
+func removeUploadState(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,686 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// metaSHA256 is the user-metadata key storing the content hash used for
+// content-addressed keys and idempotent-upload checks.
+const metaSHA256 = "rover-sha256"
+
+// Provider names accepted by -provider / ROVER_PROVIDER. Mirrors the
+// provider dispatch used by transfer.sh's cmd.go.
+const (
+	ProviderS3        = "s3"
+	ProviderS3Compat  = "s3compat"
+	ProviderGCS       = "gcs"
+	ProviderAzure     = "azure"
+	ProviderLocal     = "local"
+	providerDefault   = ProviderS3
+	providerFlagDescr = "Storage provider to upload to: s3, s3compat, gcs, azure, or local"
+)
+
+// PutInput describes an object to upload. SSE and SSEKMSKeyID configure
+// server-side encryption and are only honoured by the s3/s3compat backends;
+// other providers ignore them.
+type PutInput struct {
+	Key         string
+	Body        io.Reader
+	Size        int64
+	ContentType string
+	Metadata    map[string]string
+	SSE         string
+	SSEKMSKeyID string
+
+	// OnProgress, if set, is called by s3Storage.PutResumable as parts are
+	// transferred so the caller can render upload progress; Put
+	// implementations do not call it. total is the cumulative byte count
+	// transferred so far, updated out of part order as parts finish
+	// concurrently.
+	OnProgress func(total, size int64)
+}
+
+// Storage is the destination an archive is uploaded to. UploadCommand talks
+// to whichever backend -provider / ROVER_PROVIDER selects instead of the AWS
+// SDK directly, so rover can ship archives to whatever object store the
+// responder's org runs.
+type Storage interface {
+	Put(ctx context.Context, in PutInput) (location string, err error)
+
+	// Head reports whether key already exists, returning its stored
+	// metadata and location so a caller can skip a redundant upload.
+	Head(ctx context.Context, key string) (metadata map[string]string, location string, exists bool, err error)
+}
+
+// Resumable is implemented by backends that can continue an interrupted
+// multipart upload by UploadID instead of restarting from byte zero.
+// UploadCommand type-asserts for it and falls back to Put when a backend
+// doesn't support it.
+type Resumable interface {
+	// PutResumable reports the multipart ETag it computed from each part's
+	// UploadPart response alongside the location (for an empty archive, the
+	// ETag its single PutObject returned), so callers get the same
+	// post-upload verification as the non-resumable path.
+	PutResumable(ctx context.Context, in PutInput, src io.ReaderAt, statePath string) (location string, etag string, err error)
+}
+
+// Verifiable is implemented by backends that can confirm an uploaded
+// object's integrity after the fact and mint a time-limited download link.
+// UploadCommand type-asserts for it and omits the manifest fields a backend
+// can't support.
+type Verifiable interface {
+	// VerifyETag reports key's remote ETag and whether it matches localETag,
+	// the multipart ETag rover computed while streaming the upload.
+	VerifyETag(ctx context.Context, key, localETag string) (remoteETag string, ok bool, err error)
+
+	// PresignGet mints a GET URL for key that expires after ttl.
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+
+	// Region reports the backend's configured region for the manifest.
+	Region() string
+}
+
+// s3UploadOptions carries the multipart tuning flags that only apply to the
+// s3/s3compat backends; other providers ignore them.
+type s3UploadOptions struct {
+	partSize          int64
+	concurrency       int
+	leavePartsOnError bool
+}
+
+// newStorage builds the Storage backend named by provider, reading its
+// configuration from the provider-specific environment variables.
+func newStorage(provider string, s3Opts s3UploadOptions) (Storage, error) {
+	switch provider {
+	case ProviderS3:
+		return newS3Storage(false, s3Opts)
+	case ProviderS3Compat:
+		return newS3Storage(true, s3Opts)
+	case ProviderGCS:
+		return newGCSStorage()
+	case ProviderAzure:
+		return newAzureStorage()
+	case ProviderLocal:
+		return newLocalStorage()
+	default:
+		return nil, fmt.Errorf("unknown -provider %q: must be one of s3, s3compat, gcs, azure, local", provider)
+	}
+}
+
+// s3Storage uploads through s3manager and backs both native AWS S3 and any
+// S3-compatible endpoint (MinIO, Ceph RGW, DigitalOcean Spaces). client is
+// the s3iface.S3API interface rather than the concrete *s3.S3 client so
+// tests can exercise Head/VerifyETag/PutResumable against a fake.
+type s3Storage struct {
+	client            s3iface.S3API
+	uploader          *s3manager.Uploader
+	bucket            string
+	region            string
+	endpoint          string
+	partSize          int64
+	concurrency       int
+	leavePartsOnError bool
+}
+
+// newS3Storage builds an s3Storage from AWS_* environment variables. When
+// compat is true it also honours AWS_ENDPOINT and path-style addressing,
+// which is what S3-compatible providers require.
+func newS3Storage(compat bool, opts s3UploadOptions) (Storage, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	bucket := os.Getenv("AWS_BUCKET")
+	region := os.Getenv("AWS_REGION")
+	if len(accessKey) == 0 || len(secretKey) == 0 || len(bucket) == 0 || len(region) == 0 {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_BUCKET, and AWS_REGION must be set")
+	}
+	creds := credentials.NewStaticCredentials(accessKey, secretKey, "")
+	cfg := aws.NewConfig().WithRegion(region).WithCredentials(creds)
+	var endpoint string
+	if compat {
+		endpoint = os.Getenv("AWS_ENDPOINT")
+		if len(endpoint) == 0 {
+			return nil, fmt.Errorf("AWS_ENDPOINT must be set when -provider=s3compat")
+		}
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess := session.New()
+	client := s3.New(sess, cfg)
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.S3 = client
+		u.PartSize = opts.partSize
+		u.Concurrency = opts.concurrency
+		u.LeavePartsOnError = opts.leavePartsOnError
+	})
+	return &s3Storage{
+		client:            client,
+		uploader:          uploader,
+		bucket:            bucket,
+		region:            region,
+		endpoint:          endpoint,
+		partSize:          opts.partSize,
+		concurrency:       opts.concurrency,
+		leavePartsOnError: opts.leavePartsOnError,
+	}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, in PutInput) (string, error) {
+	meta := make(map[string]*string, len(in.Metadata))
+	for k, v := range in.Metadata {
+		meta[k] = aws.String(v)
+	}
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(in.Key),
+		Body:        in.Body,
+		ContentType: aws.String(in.ContentType),
+		Metadata:    meta,
+	}
+	if len(in.SSE) > 0 {
+		input.ServerSideEncryption = aws.String(in.SSE)
+		if in.SSE == s3.ServerSideEncryptionAwsKms && len(in.SSEKMSKeyID) > 0 {
+			input.SSEKMSKeyId = aws.String(in.SSEKMSKeyID)
+		}
+	}
+	resp, err := s.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return resp.Location, nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (map[string]string, string, bool, error) {
+	resp, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+			return nil, "", false, nil
+		}
+		return nil, "", false, err
+	}
+	meta := make(map[string]string, len(resp.Metadata))
+	for k, v := range resp.Metadata {
+		if v != nil {
+			meta[k] = *v
+		}
+	}
+	return meta, s.location(key), true, nil
+}
+
+// location reports key's URL: the path-style URL under the custom
+// AWS_ENDPOINT an s3compat provider configured (the same addressing
+// s3manager itself was forced to use via WithS3ForcePathStyle), or the
+// standard virtual-hosted-style S3 URL for native AWS S3.
+func (s *s3Storage) location(key string) string {
+	if len(s.endpoint) > 0 {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.endpoint, "/"), s.bucket, key)
+	}
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, key)
+}
+
+// VerifyETag fetches key's current ETag with a HEAD request and compares it
+// against localETag so a caller can detect a truncated or corrupted upload
+// without re-downloading the object.
+func (s *s3Storage) VerifyETag(ctx context.Context, key, localETag string) (string, bool, error) {
+	resp, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	remoteETag := aws.StringValue(resp.ETag)
+	return remoteETag, remoteETag == localETag, nil
+}
+
+// PresignGet mints a GET URL for key that expires after ttl.
+func (s *s3Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+// Region reports the region s3Storage was configured with.
+func (s *s3Storage) Region() string {
+	return s.region
+}
+
+// PutResumable uploads via the low-level multipart API instead of
+// s3manager so the in-progress UploadID can be persisted to statePath and
+// picked back up after an interruption. A previous state file is reused
+// only when it names the same bucket, key, and SHA-256, so a different
+// archive never resumes into the wrong object. UploadCommand uses it for
+// every unencrypted s3/s3compat upload, so ordinary (non-resumed) uploads
+// get the same concurrency, progress reporting, and ETag verification as a
+// resume; encrypted uploads go through Put instead.
+func (s *s3Storage) PutResumable(ctx context.Context, in PutInput, src io.ReaderAt, statePath string) (string, string, error) {
+	size := in.Size
+	if size == 0 {
+		return s.putEmptyResumable(ctx, in, statePath)
+	}
+	requestedPartSize := s.partSize
+	if requestedPartSize <= 0 {
+		requestedPartSize = partSizeDefault
+	}
+	concurrency := s.concurrency
+	if concurrency <= 0 {
+		concurrency = concurrencyDefault
+	}
+
+	state, err := loadUploadState(statePath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read resume state %s: %w", statePath, err)
+	}
+	resuming := state != nil && state.Bucket == s.bucket && state.Key == in.Key && state.SHA256 == in.Metadata[metaSHA256]
+
+	// A resumed upload must keep the part boundaries it started with: a
+	// different -part-size on the resuming run would re-partition the
+	// stream against the old state's byte offsets, corrupting the object
+	// (or panicking on the now-mismatched part count).
+	partSize := requestedPartSize
+	if resuming && state.PartSize != 0 {
+		if state.PartSize != requestedPartSize {
+			return "", "", fmt.Errorf("resume state %s was started with -part-size=%d but this run passed -part-size=%d; rerun with -part-size=%d or delete %s to start the upload over", statePath, state.PartSize, requestedPartSize, state.PartSize, statePath)
+		}
+		partSize = state.PartSize
+	}
+	numParts := (size + partSize - 1) / partSize
+
+	completed := map[int64]string{}
+	var transferred int64
+	if resuming {
+		for _, p := range state.CompletedParts {
+			completed[p.PartNumber] = p.ETag
+			transferred += partLength(p.PartNumber, size, partSize)
+		}
+	} else {
+		meta := make(map[string]*string, len(in.Metadata))
+		for k, v := range in.Metadata {
+			meta[k] = aws.String(v)
+		}
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(in.Key),
+			ContentType: aws.String(in.ContentType),
+			Metadata:    meta,
+		}
+		if len(in.SSE) > 0 {
+			input.ServerSideEncryption = aws.String(in.SSE)
+			if in.SSE == s3.ServerSideEncryptionAwsKms && len(in.SSEKMSKeyID) > 0 {
+				input.SSEKMSKeyId = aws.String(in.SSEKMSKeyID)
+			}
+		}
+		created, err := s.client.CreateMultipartUploadWithContext(ctx, input)
+		if err != nil {
+			return "", "", err
+		}
+		state = &uploadState{Bucket: s.bucket, Key: in.Key, UploadID: *created.UploadId, SHA256: in.Metadata[metaSHA256], PartSize: partSize, NumParts: numParts}
+		if err := saveUploadState(statePath, state); err != nil {
+			return "", "", err
+		}
+	}
+	if in.OnProgress != nil && transferred > 0 {
+		in.OnProgress(transferred, size)
+	}
+
+	partETags := make([]string, numParts)
+	for partNumber, etag := range completed {
+		partETags[partNumber-1] = etag
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+	}
+	for i := int64(0); i < numParts; i++ {
+		partNumber := i + 1
+		if _, ok := completed[partNumber]; ok {
+			continue
+		}
+		offset := i * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(partNumber, offset, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			buf := make([]byte, length)
+			if _, err := src.ReadAt(buf, offset); err != nil && err != io.EOF {
+				fail(err)
+				return
+			}
+			resp, err := s.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(s.bucket),
+				Key:        aws.String(in.Key),
+				UploadId:   aws.String(state.UploadID),
+				PartNumber: aws.Int64(partNumber),
+				Body:       bytes.NewReader(buf),
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			partETags[partNumber-1] = aws.StringValue(resp.ETag)
+			state.CompletedParts = append(state.CompletedParts, completedPart{PartNumber: partNumber, ETag: aws.StringValue(resp.ETag)})
+			saveErr := saveUploadState(statePath, state)
+			mu.Unlock()
+			if saveErr != nil {
+				fail(saveErr)
+				return
+			}
+
+			if in.OnProgress != nil {
+				in.OnProgress(atomic.AddInt64(&transferred, length), size)
+			}
+		}(partNumber, offset, length)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return "", "", s.abortOnError(in.Key, state.UploadID, statePath, firstErr)
+	}
+
+	completedParts := make([]*s3.CompletedPart, numParts)
+	for i, etag := range partETags {
+		completedParts[i] = &s3.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int64(int64(i + 1))}
+	}
+	if _, err := s.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(in.Key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	}); err != nil {
+		return "", "", s.abortOnError(in.Key, state.UploadID, statePath, err)
+	}
+	if err := removeUploadState(statePath); err != nil {
+		return "", "", err
+	}
+	return s.location(in.Key), multipartETagFromParts(partETags), nil
+}
+
+// putEmptyResumable handles the zero-byte archive edge case: S3 rejects a
+// CompleteMultipartUpload with no parts, so an empty file goes through a
+// plain PutObject instead of the multipart path.
+func (s *s3Storage) putEmptyResumable(ctx context.Context, in PutInput, statePath string) (string, string, error) {
+	meta := make(map[string]*string, len(in.Metadata))
+	for k, v := range in.Metadata {
+		meta[k] = aws.String(v)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(in.Key),
+		Body:        bytes.NewReader(nil),
+		ContentType: aws.String(in.ContentType),
+		Metadata:    meta,
+	}
+	if len(in.SSE) > 0 {
+		input.ServerSideEncryption = aws.String(in.SSE)
+		if in.SSE == s3.ServerSideEncryptionAwsKms && len(in.SSEKMSKeyID) > 0 {
+			input.SSEKMSKeyId = aws.String(in.SSEKMSKeyID)
+		}
+	}
+	resp, err := s.client.PutObjectWithContext(ctx, input)
+	if err != nil {
+		return "", "", err
+	}
+	if in.OnProgress != nil {
+		in.OnProgress(0, 0)
+	}
+	if err := removeUploadState(statePath); err != nil {
+		return "", "", err
+	}
+	return s.location(in.Key), aws.StringValue(resp.ETag), nil
+}
+
+// partLength reports the byte length of partNumber (1-indexed) in a file of
+// size bytes split into partSize chunks.
+func partLength(partNumber, size, partSize int64) int64 {
+	offset := (partNumber - 1) * partSize
+	length := partSize
+	if offset+length > size {
+		length = size - offset
+	}
+	return length
+}
+
+// abortOnError wraps cause, which failed or aborted a multipart upload: unless
+// -leave-parts-on-error is set, it aborts the MPU (the request's own ctx may
+// already be cancelled, so this uses a fresh background context) and clears
+// the now-invalid resume state so a later run starts over instead of trying
+// to resume an upload ID that no longer exists.
+func (s *s3Storage) abortOnError(key, uploadID, statePath string, cause error) error {
+	if s.leavePartsOnError {
+		return cause
+	}
+	abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := s.client.AbortMultipartUploadWithContext(abortCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}); err != nil {
+		return fmt.Errorf("%w (and failed to abort multipart upload %s: %s)", cause, uploadID, err)
+	}
+	if err := removeUploadState(statePath); err != nil {
+		return fmt.Errorf("%w (aborted multipart upload, but failed to clear resume state %s: %s)", cause, statePath, err)
+	}
+	return cause
+}
+
+// gcsStorage uploads to a Google Cloud Storage bucket.
+type gcsStorage struct {
+	client *storage.Client
+	bucket string
+}
+
+// newGCSStorage builds a gcsStorage from GOOGLE_APPLICATION_CREDENTIALS and
+// GCS_BUCKET, following the client library's own default credential lookup.
+func newGCSStorage() (Storage, error) {
+	bucket := os.Getenv("GCS_BUCKET")
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("GCS_BUCKET must be set when -provider=gcs")
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not create GCS client: %w", err)
+	}
+	return &gcsStorage{client: client, bucket: bucket}, nil
+}
+
+func (g *gcsStorage) Put(ctx context.Context, in PutInput) (string, error) {
+	w := g.client.Bucket(g.bucket).Object(in.Key).NewWriter(ctx)
+	w.ContentType = in.ContentType
+	w.Metadata = in.Metadata
+	if _, err := io.Copy(w, in.Body); err != nil {
+		_ = w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", g.bucket, in.Key), nil
+}
+
+func (g *gcsStorage) Head(ctx context.Context, key string) (map[string]string, string, bool, error) {
+	attrs, err := g.client.Bucket(g.bucket).Object(key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	return attrs.Metadata, fmt.Sprintf("gs://%s/%s", g.bucket, key), true, nil
+}
+
+// azureStorage uploads to an Azure Blob Storage container.
+type azureStorage struct {
+	container     azblob.ContainerURL
+	account       string
+	containerName string
+}
+
+// newAzureStorage builds an azureStorage from AZURE_STORAGE_ACCOUNT,
+// AZURE_STORAGE_KEY, and AZURE_CONTAINER.
+func newAzureStorage() (Storage, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	key := os.Getenv("AZURE_STORAGE_KEY")
+	container := os.Getenv("AZURE_CONTAINER")
+	if len(account) == 0 || len(key) == 0 || len(container) == 0 {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT, AZURE_STORAGE_KEY, and AZURE_CONTAINER must be set when -provider=azure")
+	}
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Azure credential: %w", err)
+	}
+	pipeline := azblob.NewPipeline(cred, azblob.PipelineOptions{})
+	u, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", account, container))
+	if err != nil {
+		return nil, fmt.Errorf("could not build Azure container URL: %w", err)
+	}
+	return &azureStorage{container: azblob.NewContainerURL(*u, pipeline), account: account, containerName: container}, nil
+}
+
+// azureMetaKey translates a rover metadata key (e.g. "rover-sha256") into
+// the form Azure Blob Storage requires: metadata names must be valid C#
+// identifiers, so hyphens aren't allowed. None of rover's own keys contain
+// an underscore, so this translation is unambiguous to reverse.
+func azureMetaKey(key string) string {
+	return strings.ReplaceAll(key, "-", "_")
+}
+
+// azureMetaKeyFromAzure reverses azureMetaKey so Head reports the same keys
+// every other backend uses.
+func azureMetaKeyFromAzure(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+func (a *azureStorage) Put(ctx context.Context, in PutInput) (string, error) {
+	blobURL := a.container.NewBlockBlobURL(in.Key)
+	meta := azblob.Metadata{}
+	for k, v := range in.Metadata {
+		meta[azureMetaKey(k)] = v
+	}
+	_, err := azblob.UploadStreamToBlockBlob(ctx, in.Body, blobURL, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: 4 * 1024 * 1024,
+		MaxBuffers: 4,
+		Metadata:   meta,
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentType: in.ContentType,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", a.account, a.containerName, in.Key), nil
+}
+
+func (a *azureStorage) Head(ctx context.Context, key string) (map[string]string, string, bool, error) {
+	blobURL := a.container.NewBlockBlobURL(key)
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return nil, "", false, nil
+		}
+		return nil, "", false, err
+	}
+	rawMeta := props.NewMetadata()
+	meta := make(map[string]string, len(rawMeta))
+	for k, v := range rawMeta {
+		meta[azureMetaKeyFromAzure(k)] = v
+	}
+	return meta, fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", a.account, a.containerName, key), true, nil
+}
+
+// localStorage writes archives to a directory on disk for air-gapped
+// operators who cannot reach any object store.
+type localStorage struct {
+	baseDir string
+}
+
+// newLocalStorage builds a localStorage rooted at ROVER_LOCAL_DIR (default
+// "./rover-uploads").
+func newLocalStorage() (Storage, error) {
+	dir := os.Getenv("ROVER_LOCAL_DIR")
+	if len(dir) == 0 {
+		dir = "rover-uploads"
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create local storage directory %s: %w", dir, err)
+	}
+	return &localStorage{baseDir: dir}, nil
+}
+
+func (l *localStorage) Put(ctx context.Context, in PutInput) (string, error) {
+	dest := filepath.Join(l.baseDir, in.Key)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return "", err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, in.Body); err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return dest, nil
+	}
+	return abs, nil
+}
+
+// Head checks for a file at key; the local sink has no metadata store, so
+// it reports existence only.
+func (l *localStorage) Head(ctx context.Context, key string) (map[string]string, string, bool, error) {
+	dest := filepath.Join(l.baseDir, key)
+	if _, err := os.Stat(dest); err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", false, nil
+		}
+		return nil, "", false, err
+	}
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		abs = dest
+	}
+	return nil, abs, true, nil
+}
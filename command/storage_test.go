@@ -0,0 +1,408 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3Client stubs the handful of s3iface.S3API methods s3Storage actually
+// calls. It embeds the interface unset, so any method this test doesn't
+// configure panics on use rather than silently returning a zero value.
+type fakeS3Client struct {
+	s3iface.S3API
+
+	headObjectFunc              func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	createMultipartUploadFunc   func(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	uploadPartFunc              func(*s3.UploadPartInput) (*s3.UploadPartOutput, error)
+	completeMultipartUploadFunc func(*s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	putObjectFunc               func(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+
+	mu              sync.Mutex
+	aborted         bool
+	abortedUploadID string
+	uploadPartCalls int
+}
+
+func (f *fakeS3Client) HeadObjectWithContext(_ aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	return f.headObjectFunc(in)
+}
+
+func (f *fakeS3Client) CreateMultipartUploadWithContext(_ aws.Context, in *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return f.createMultipartUploadFunc(in)
+}
+
+func (f *fakeS3Client) UploadPartWithContext(_ aws.Context, in *s3.UploadPartInput, _ ...request.Option) (*s3.UploadPartOutput, error) {
+	f.mu.Lock()
+	f.uploadPartCalls++
+	f.mu.Unlock()
+	return f.uploadPartFunc(in)
+}
+
+func (f *fakeS3Client) CompleteMultipartUploadWithContext(_ aws.Context, in *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return f.completeMultipartUploadFunc(in)
+}
+
+func (f *fakeS3Client) AbortMultipartUploadWithContext(_ aws.Context, in *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	f.aborted = true
+	f.abortedUploadID = aws.StringValue(in.UploadId)
+	f.mu.Unlock()
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3Client) PutObjectWithContext(_ aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	return f.putObjectFunc(in)
+}
+
+func TestS3StorageHead(t *testing.T) {
+	notFound := awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+
+	cases := []struct {
+		name       string
+		headFunc   func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+		wantExists bool
+		wantErr    bool
+	}{
+		{
+			name: "exists",
+			headFunc: func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{Metadata: map[string]*string{metaSHA256: aws.String("abc")}}, nil
+			},
+			wantExists: true,
+		},
+		{
+			name: "not found",
+			headFunc: func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+				return nil, notFound
+			},
+			wantExists: false,
+		},
+		{
+			name: "other error",
+			headFunc: func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+				return nil, fmt.Errorf("network blip")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &s3Storage{client: &fakeS3Client{headObjectFunc: tc.headFunc}, bucket: "bucket"}
+			meta, _, exists, err := s.Head(context.Background(), "key")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Head() err = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Head() err = %v", err)
+			}
+			if exists != tc.wantExists {
+				t.Fatalf("Head() exists = %v, want %v", exists, tc.wantExists)
+			}
+			if tc.wantExists && meta[metaSHA256] != "abc" {
+				t.Fatalf("Head() metadata[%s] = %q, want %q", metaSHA256, meta[metaSHA256], "abc")
+			}
+		})
+	}
+}
+
+func TestS3StorageVerifyETag(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteETag string
+		localETag  string
+		wantOK     bool
+	}{
+		{"matches", `"abc123"`, `"abc123"`, true},
+		{"mismatches", `"abc123"`, `"def456"`, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeS3Client{headObjectFunc: func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+				return &s3.HeadObjectOutput{ETag: aws.String(tc.remoteETag)}, nil
+			}}
+			s := &s3Storage{client: client, bucket: "bucket"}
+			remote, ok, err := s.VerifyETag(context.Background(), "key", tc.localETag)
+			if err != nil {
+				t.Fatalf("VerifyETag() err = %v", err)
+			}
+			if ok != tc.wantOK {
+				t.Fatalf("VerifyETag() ok = %v, want %v", ok, tc.wantOK)
+			}
+			if remote != tc.remoteETag {
+				t.Fatalf("VerifyETag() remoteETag = %q, want %q", remote, tc.remoteETag)
+			}
+		})
+	}
+}
+
+// newPartUploadFake returns a fakeS3Client whose UploadPartWithContext mints
+// a deterministic hex-digest ETag per part number, and whose
+// CompleteMultipartUpload just records the parts it was asked to complete.
+func newPartUploadFake() *fakeS3Client {
+	return &fakeS3Client{
+		createMultipartUploadFunc: func(*s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+			return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+		},
+		uploadPartFunc: func(in *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+			return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"%032x"`, aws.Int64Value(in.PartNumber)))}, nil
+		},
+		completeMultipartUploadFunc: func(*s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+			return &s3.CompleteMultipartUploadOutput{}, nil
+		},
+	}
+}
+
+func TestS3StoragePutResumableFreshUpload(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), uploadStateFile)
+	client := newPartUploadFake()
+	s := &s3Storage{client: client, bucket: "bucket", partSize: 8, concurrency: 2}
+
+	data := bytes.Repeat([]byte("a"), 20)
+	in := PutInput{Key: "key", Size: int64(len(data)), Metadata: map[string]string{metaSHA256: "abc"}}
+	_, etag, err := s.PutResumable(context.Background(), in, bytes.NewReader(data), statePath)
+	if err != nil {
+		t.Fatalf("PutResumable() err = %v", err)
+	}
+	if client.uploadPartCalls != 3 {
+		t.Fatalf("uploadPartCalls = %d, want 3 (two full parts + one partial)", client.uploadPartCalls)
+	}
+	if etag == "" {
+		t.Fatalf("PutResumable() returned empty etag")
+	}
+	if st, err := loadUploadState(statePath); err != nil || st != nil {
+		t.Fatalf("resume state should be removed after a successful upload, got %+v, err %v", st, err)
+	}
+}
+
+func TestS3StoragePutResumableResumesCompletedParts(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), uploadStateFile)
+	existing := &uploadState{
+		Bucket:         "bucket",
+		Key:            "key",
+		UploadID:       "upload-1",
+		SHA256:         "abc",
+		PartSize:       8,
+		NumParts:       3,
+		CompletedParts: []completedPart{{PartNumber: 1, ETag: `"part-1"`}},
+	}
+	if err := saveUploadState(statePath, existing); err != nil {
+		t.Fatalf("saveUploadState: %v", err)
+	}
+
+	client := newPartUploadFake()
+	s := &s3Storage{client: client, bucket: "bucket", partSize: 8, concurrency: 2}
+
+	data := bytes.Repeat([]byte("a"), 20)
+	in := PutInput{Key: "key", Size: int64(len(data)), Metadata: map[string]string{metaSHA256: "abc"}}
+	if _, _, err := s.PutResumable(context.Background(), in, bytes.NewReader(data), statePath); err != nil {
+		t.Fatalf("PutResumable() err = %v", err)
+	}
+	if client.uploadPartCalls != 2 {
+		t.Fatalf("uploadPartCalls = %d, want 2 (part 1 already completed)", client.uploadPartCalls)
+	}
+}
+
+func TestS3StoragePutResumableRejectsPartSizeChange(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), uploadStateFile)
+	existing := &uploadState{
+		Bucket:   "bucket",
+		Key:      "key",
+		UploadID: "upload-1",
+		SHA256:   "abc",
+		PartSize: 8,
+		NumParts: 2,
+	}
+	if err := saveUploadState(statePath, existing); err != nil {
+		t.Fatalf("saveUploadState: %v", err)
+	}
+
+	client := newPartUploadFake()
+	// Same client/bucket/key/SHA256 as the saved state, but a different
+	// -part-size than the upload was started with.
+	s := &s3Storage{client: client, bucket: "bucket", partSize: 4, concurrency: 2}
+
+	data := bytes.Repeat([]byte("a"), 16)
+	in := PutInput{Key: "key", Size: int64(len(data)), Metadata: map[string]string{metaSHA256: "abc"}}
+	_, _, err := s.PutResumable(context.Background(), in, bytes.NewReader(data), statePath)
+	if err == nil {
+		t.Fatalf("PutResumable() err = nil, want a -part-size mismatch error")
+	}
+	if !strings.Contains(err.Error(), "-part-size") {
+		t.Fatalf("PutResumable() err = %v, want it to mention -part-size", err)
+	}
+	if client.uploadPartCalls != 0 {
+		t.Fatalf("uploadPartCalls = %d, want 0 parts uploaded before rejecting the mismatch", client.uploadPartCalls)
+	}
+}
+
+func TestS3StoragePutResumableAbortsOnPartFailure(t *testing.T) {
+	cases := []struct {
+		name              string
+		leavePartsOnError bool
+		wantAborted       bool
+	}{
+		{"aborts by default", false, true},
+		{"leaves parts when requested", true, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			statePath := filepath.Join(t.TempDir(), uploadStateFile)
+			client := newPartUploadFake()
+			client.uploadPartFunc = func(*s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+				return nil, fmt.Errorf("simulated network failure")
+			}
+			s := &s3Storage{client: client, bucket: "bucket", partSize: 8, concurrency: 2, leavePartsOnError: tc.leavePartsOnError}
+
+			data := bytes.Repeat([]byte("a"), 20)
+			in := PutInput{Key: "key", Size: int64(len(data)), Metadata: map[string]string{metaSHA256: "abc"}}
+			_, _, err := s.PutResumable(context.Background(), in, bytes.NewReader(data), statePath)
+			if err == nil {
+				t.Fatalf("PutResumable() err = nil, want the simulated failure")
+			}
+
+			client.mu.Lock()
+			aborted := client.aborted
+			client.mu.Unlock()
+			if aborted != tc.wantAborted {
+				t.Fatalf("aborted = %v, want %v", aborted, tc.wantAborted)
+			}
+
+			st, loadErr := loadUploadState(statePath)
+			if tc.wantAborted {
+				if loadErr != nil || st != nil {
+					t.Fatalf("resume state should be cleared after an abort, got %+v, err %v", st, loadErr)
+				}
+			} else if st == nil {
+				t.Fatalf("resume state should survive when -leave-parts-on-error is set")
+			}
+		})
+	}
+}
+
+func TestLocalStoragePutAndHead(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ROVER_LOCAL_DIR", dir)
+
+	store, err := newLocalStorage()
+	if err != nil {
+		t.Fatalf("newLocalStorage() err = %v", err)
+	}
+	l := store.(*localStorage)
+
+	if _, _, exists, err := l.Head(context.Background(), "archives/bundle.tar.gz"); err != nil || exists {
+		t.Fatalf("Head() before Put = exists %v, err %v, want false, nil", exists, err)
+	}
+
+	data := []byte("diagnostic bundle contents")
+	loc, err := l.Put(context.Background(), PutInput{Key: "archives/bundle.tar.gz", Body: bytes.NewReader(data)})
+	if err != nil {
+		t.Fatalf("Put() err = %v", err)
+	}
+	if loc == "" {
+		t.Fatalf("Put() returned empty location")
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "archives/bundle.tar.gz"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("file contents = %q, want %q", got, data)
+	}
+
+	_, location, exists, err := l.Head(context.Background(), "archives/bundle.tar.gz")
+	if err != nil {
+		t.Fatalf("Head() err = %v", err)
+	}
+	if !exists {
+		t.Fatalf("Head() exists = false, want true")
+	}
+	if location == "" {
+		t.Fatalf("Head() returned empty location for an existing file")
+	}
+}
+
+func TestNewStorageUnknownProvider(t *testing.T) {
+	if _, err := newStorage("not-a-real-provider", s3UploadOptions{}); err == nil {
+		t.Fatalf("newStorage() err = nil, want an error for an unknown provider")
+	}
+}
+
+func TestNewStorageLocalProvider(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ROVER_LOCAL_DIR", filepath.Join(dir, "uploads"))
+
+	store, err := newStorage(ProviderLocal, s3UploadOptions{})
+	if err != nil {
+		t.Fatalf("newStorage(%q) err = %v", ProviderLocal, err)
+	}
+	if _, ok := store.(*localStorage); !ok {
+		t.Fatalf("newStorage(%q) = %T, want *localStorage", ProviderLocal, store)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "uploads")); err != nil {
+		t.Fatalf("newStorage(%q) did not create its base dir: %v", ProviderLocal, err)
+	}
+}
+
+func TestS3StorageLocation(t *testing.T) {
+	cases := []struct {
+		name     string
+		endpoint string
+		want     string
+	}{
+		{
+			name: "native s3 uses the virtual-hosted-style URL",
+			want: "https://bucket.s3.amazonaws.com/key",
+		},
+		{
+			name:     "s3compat uses the path-style URL under AWS_ENDPOINT",
+			endpoint: "https://minio.example.com:9000",
+			want:     "https://minio.example.com:9000/bucket/key",
+		},
+		{
+			name:     "s3compat trims a trailing slash off AWS_ENDPOINT",
+			endpoint: "https://minio.example.com:9000/",
+			want:     "https://minio.example.com:9000/bucket/key",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &s3Storage{bucket: "bucket", endpoint: tc.endpoint}
+			if got := s.location("key"); got != tc.want {
+				t.Fatalf("location() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAzureMetaKeyRoundTrip(t *testing.T) {
+	keys := []string{metaSHA256, metaHostName, metaOS, metaVersion, metaCapturedAt, metaEncryption, metaNonce, metaWrappedKey, metaKMSKeyID, metaKDFSalt}
+	for _, k := range keys {
+		azureKey := azureMetaKey(k)
+		if strings.Contains(azureKey, "-") {
+			t.Fatalf("azureMetaKey(%q) = %q, still contains a hyphen Azure would reject", k, azureKey)
+		}
+		if got := azureMetaKeyFromAzure(azureKey); got != k {
+			t.Fatalf("azureMetaKeyFromAzure(azureMetaKey(%q)) = %q, want %q", k, got, k)
+		}
+	}
+}
@@ -4,43 +4,95 @@ package command
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/briandowns/spinner"
 	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/cli"
-	"github.com/ryanuber/columnize"
 )
 
 const (
 	archiveFileDefault = "rover.zip"
 	archiveFileDescr   = "Archive filename"
+
+	partSizeDefault          = 64 * 1024 * 1024 // 64MB
+	partSizeDescr            = "Size in bytes of each multipart upload part"
+	concurrencyDefault       = 5
+	concurrencyDescr         = "Number of concurrent multipart upload parts in flight"
+	leavePartsOnErrorDefault = false
+	leavePartsOnErrorDescr   = "Do not abort the multipart upload on error, leaving uploaded parts in the bucket"
+
+	encryptDefault = false
+	encryptDescr   = "Encrypt the archive client-side (AES-256-GCM) before uploading"
+	kmsKeyIDDescr  = "AWS KMS key ID used to wrap the data key when -encrypt is set; falls back to ROVER_PASSPHRASE otherwise"
+	sseDescr       = "Server-side encryption mode to request from the storage provider: AES256 or aws:kms (s3/s3compat only)"
+
+	outputDefault     = "text"
+	outputDescr       = "Output format: text or json (json also prints the upload manifest to stdout)"
+	presignTTLDefault = 24 * time.Hour
+	presignTTLDescr   = "How long the manifest's presigned download URL remains valid (s3/s3compat only)"
+)
+
+// User metadata keys recorded on every uploaded archive so downstream
+// tooling can index them without re-reading the object.
+const (
+	metaHostName   = "rover-hostname"
+	metaOS         = "rover-os"
+	metaVersion    = "rover-version"
+	metaCapturedAt = "rover-captured-at"
 )
 
 // UploadCommand describes upload related fields
 type UploadCommand struct {
-	AccessKey   string
-	ArchiveFile string
-	Bucket      string
-	HostName    string
-	OS          string
-	Prefix      string
-	Region      string
-	SecretKey   string
-	Token       string
-	UI          cli.Ui
+	ArchiveFile       string
+	Concurrency       int
+	Encrypt           bool
+	HostName          string
+	KMSKeyID          string
+	LeavePartsOnError bool
+	OS                string
+	Output            string
+	PartSize          int64
+	Prefix            string
+	PresignTTL        time.Duration
+	Provider          string
+	SSE               string
+	UI                cli.Ui
+}
+
+// progressReader wraps an io.Reader and reports bytes read so far, letting
+// the caller render a progress spinner instead of an indeterminate one.
+type progressReader struct {
+	reader io.Reader
+	size   int64
+	read   int64
+	onRead func(read, size int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		total := atomic.AddInt64(&p.read, int64(n))
+		if p.onRead != nil {
+			p.onRead(total, p.size)
+		}
+	}
+	return n, err
 }
 
 // Help output
@@ -51,10 +103,22 @@ Usage: rover upload [options]
 
 General Options:
   -file="rover-host-20171028110212.zip"	Specify the filename to upload.
+  -provider=s3					Storage provider: s3, s3compat, gcs, azure, or local.
+  -part-size=67108864				Size in bytes of each multipart upload part (s3/s3compat only).
+  -concurrency=5				Number of concurrent multipart upload parts in flight (s3/s3compat only).
+  -leave-parts-on-error=false			Do not abort the multipart upload on error (s3/s3compat only).
+  -encrypt=false				Encrypt the archive client-side (AES-256-GCM) before uploading.
+  -kms-key-id=""				AWS KMS key ID to wrap the data key; falls back to ROVER_PASSPHRASE.
+  -sse=""					Server-side encryption mode: AES256 or aws:kms (s3/s3compat only).
+  -output=text					Output format: text or json (json also prints the upload manifest).
+  -presign-ttl=24h				Validity of the manifest's presigned download URL (s3/s3compat only).
 
 Environment Variables:
 
-  The upload command requires these environment variables:
+  ROVER_PROVIDER selects the storage backend in place of -provider.
+  ROVER_PASSPHRASE derives the data key via scrypt when -encrypt is set without -kms-key-id.
+
+  The s3 provider requires:
 
   - AWS_ACCESS_KEY_ID
   - AWS_SECRET_ACCESS_KEY
@@ -64,6 +128,15 @@ Environment Variables:
   Optionally specify a bucket prefix:
 
   - AWS_PREFIX
+
+  The s3compat provider additionally requires AWS_ENDPOINT.
+  The gcs provider requires GCS_BUCKET.
+  The azure provider requires AZURE_STORAGE_ACCOUNT, AZURE_STORAGE_KEY, and AZURE_CONTAINER.
+  The local provider writes under ROVER_LOCAL_DIR (default "rover-uploads").
+
+  Every completed upload writes rover-upload-manifest.json describing where
+  the archive landed (a skipped re-upload of an existing archive does not); s3/s3compat uploads also verify the object's ETag and mint a
+  presigned download URL.
 `
 
 	return strings.TrimSpace(helpText)
@@ -100,30 +173,37 @@ func (c *UploadCommand) Run(args []string) int {
 	cmdFlags := flag.NewFlagSet("upload", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.UI.Output(c.Help()) }
 	cmdFlags.StringVar(&c.ArchiveFile, "file", archiveFileDefault, archiveFileDescr)
+	cmdFlags.StringVar(&c.Provider, "provider", providerDefault, providerFlagDescr)
+	cmdFlags.Int64Var(&c.PartSize, "part-size", partSizeDefault, partSizeDescr)
+	cmdFlags.IntVar(&c.Concurrency, "concurrency", concurrencyDefault, concurrencyDescr)
+	cmdFlags.BoolVar(&c.LeavePartsOnError, "leave-parts-on-error", leavePartsOnErrorDefault, leavePartsOnErrorDescr)
+	cmdFlags.BoolVar(&c.Encrypt, "encrypt", encryptDefault, encryptDescr)
+	cmdFlags.StringVar(&c.KMSKeyID, "kms-key-id", "", kmsKeyIDDescr)
+	cmdFlags.StringVar(&c.SSE, "sse", "", sseDescr)
+	cmdFlags.StringVar(&c.Output, "output", outputDefault, outputDescr)
+	cmdFlags.DurationVar(&c.PresignTTL, "presign-ttl", presignTTLDefault, presignTTLDescr)
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
-	c.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
-	c.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
-	c.Bucket = os.Getenv("AWS_BUCKET")
+	if envProvider := os.Getenv("ROVER_PROVIDER"); len(envProvider) > 0 {
+		c.Provider = envProvider
+	}
+	if err := validateUploadFlags(c.Output, c.PartSize, c.Provider, c.SSE, c.KMSKeyID, c.Encrypt); err != nil {
+		c.UI.Error(err.Error())
+		logger.Error("upload", "error", err.Error())
+		return 1
+	}
 	c.Prefix = os.Getenv("AWS_PREFIX")
-	c.Region = os.Getenv("AWS_REGION")
-	c.Token = ""
-	if len(c.AccessKey) == 0 || len(c.SecretKey) == 0 || len(c.Bucket) == 0 || len(c.Region) == 0 {
-		logger.Error("missing at least one of the required AWS credential environment variables")
-		columns := []string{}
-		kvs := map[string]string{"AWS_ACCESS_KEY_ID": "Access key ID for AWS", "AWS_SECRET_ACCESS_KEY": "Secret access key ID for AWS", "AWS_BUCKET": " Name of the S3 bucket", "AWS_REGION": "AWS region for the bucket"}
-		for k, v := range kvs {
-			columns = append(columns, fmt.Sprintf("%s: | %s ", k, v))
-		}
-		envVars := columnize.SimpleFormat(columns)
-		out := fmt.Sprintf("One or more required environment variables are not set;\n please ensure that the following environment variables are set:\n\n%s", envVars)
-		c.UI.Error(out)
+	store, err := newStorage(c.Provider, s3UploadOptions{
+		partSize:          c.PartSize,
+		concurrency:       c.Concurrency,
+		leavePartsOnError: c.LeavePartsOnError,
+	})
+	if err != nil {
+		logger.Error("upload", "error", err.Error())
+		c.UI.Error(err.Error())
 		return 1
 	}
-	creds := credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, c.Token)
-	cfg := aws.NewConfig().WithRegion(c.Region).WithCredentials(creds)
-	svc := s3.New(session.New(), cfg)
 	file, err := os.Open(c.ArchiveFile)
 	if err != nil {
 		out := fmt.Sprintf("Error opening %s! Error: %v", c.ArchiveFile, err)
@@ -132,9 +212,7 @@ func (c *UploadCommand) Run(args []string) int {
 		return 1
 	}
 	defer func() {
-		// Close after zip file is successfully uploaded
-		err = file.Close()
-		if err != nil {
+		if err := file.Close(); err != nil {
 			out := fmt.Sprintf("Could not close %s! Error: %v", c.ArchiveFile, err)
 			c.UI.Error(out)
 			os.Exit(1)
@@ -147,51 +225,281 @@ func (c *UploadCommand) Run(args []string) int {
 		return 1
 	}
 	var fileSize int64 = fileInfo.Size()
-	buffer := make([]byte, fileSize)
-	defer func() {
-		// Read from the buffer
-		_, err = file.Read(buffer)
-		if err != nil {
-			out := fmt.Sprintf("Could not read buffer! Error: %s", err)
-			logger.Error("upload", "error", err.Error())
-			c.UI.Error(out)
-			os.Exit(1)
-		}
-	}()
-	path := fmt.Sprintf("%s/%s", c.Prefix, file.Name())
-	fileBytes := bytes.NewReader(buffer)
-	// For more than application/zip later
-	fileType := http.DetectContentType(buffer)
-	params := &s3.PutObjectInput{
-		Bucket:        aws.String(c.Bucket),
-		Key:           aws.String(path),
-		Body:          fileBytes,
-		ContentLength: aws.Int64(fileSize),
-		ContentType:   aws.String(fileType),
+
+	// Sniff the content type off the first 512 bytes rather than buffering
+	// the whole archive into memory.
+	sniff := make([]byte, 512)
+	n, err := file.Read(sniff)
+	if err != nil && err != io.EOF {
+		out := fmt.Sprintf("Could not read %s! Error: %v", c.ArchiveFile, err)
+		c.UI.Error(out)
+		return 1
 	}
+	fileType := http.DetectContentType(sniff[:n])
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		out := fmt.Sprintf("Could not seek %s! Error: %v", c.ArchiveFile, err)
+		c.UI.Error(out)
+		return 1
+	}
+
 	// Shout out to Ye Olde School BSD spinner!
 	roverSpinnerSet := []string{"/", "|", "\\", "-", "|", "\\", "-"}
 	s := spinner.New(roverSpinnerSet, 174*time.Millisecond)
 	s.Writer = os.Stderr
-	err = s.Color("fgHiCyan")
-	if err != nil {
+	if err := s.Color("fgHiCyan"); err != nil {
 		logger.Warn("upload", "weird-error", err.Error())
 	}
-	s.Suffix = " Gathering Vault information ..."
-	s.FinalMSG = fmt.Sprintf("Success! Uploaded s3://%s/%s", c.Bucket, file.Name())
+	s.Suffix = " Computing archive fingerprint ..."
 	s.Start()
 
-	resp, err := svc.PutObject(params)
-	if err != nil {
-		out := fmt.Sprintf("Error: %s from AWS! Response: %s", err, resp)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		s.Stop()
+		out := fmt.Sprintf("Could not hash %s! Error: %v", c.ArchiveFile, err)
+		c.UI.Error(out)
+		return 1
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		s.Stop()
+		out := fmt.Sprintf("Could not seek %s! Error: %v", c.ArchiveFile, err)
 		c.UI.Error(out)
+		return 1
+	}
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+	now := time.Now()
+	capturedAt := now.UTC()
+	// The key is addressed by content hash alone (plus hostname, to keep
+	// archives from different hosts apart) so re-uploading the same bytes
+	// always lands on the same object and the Head check below can find
+	// it, regardless of what day it's re-run. The capture date is still
+	// recorded in metaCapturedAt metadata for indexing.
+	path := fmt.Sprintf("%s/%s/%s-%s", c.Prefix, c.HostName, fingerprint, filepath.Base(file.Name()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if existingMeta, location, exists, err := store.Head(ctx, path); err != nil {
+		logger.Warn("upload", "head-check-error", err.Error())
+	} else if alreadyUploaded(exists, existingMeta, fingerprint) {
+		s.Stop()
+		c.UI.Output(fmt.Sprintf("Already uploaded: %s", location))
+		return 0
+	}
+
+	s.Suffix = " Gathering Vault information ..."
+
+	start := now
+	var lastReport int64
+	onProgress := func(read, size int64) {
+		// Throttle spinner updates so we're not formatting a string on
+		// every Read() call.
+		if read-atomic.LoadInt64(&lastReport) < c.PartSize/4 && read != size {
+			return
+		}
+		atomic.StoreInt64(&lastReport, read)
+		elapsed := time.Since(start).Seconds()
+		rate := float64(read) / 1024 / 1024
+		if elapsed > 0 {
+			rate = rate / elapsed
+		}
+		pct := float64(read) / float64(size) * 100
+		// s.Suffix is read by the spinner's own render goroutine once
+		// Start() has run, so mutations from here must take its lock.
+		s.Lock()
+		s.Suffix = fmt.Sprintf(" Uploading %s: %.1f%% (%.2f MB/s)", filepath.Base(file.Name()), pct, rate)
+		s.Unlock()
+	}
+	reader := &progressReader{
+		reader: file,
+		size:   fileSize,
+		onRead: onProgress,
+	}
+
+	metadata := map[string]string{
+		metaSHA256:     fingerprint,
+		metaHostName:   c.HostName,
+		metaOS:         c.OS,
+		metaVersion:    Version,
+		metaCapturedAt: capturedAt.Format(time.RFC3339),
+	}
+
+	var body io.Reader = reader
+	resumable, canResume := store.(Resumable)
+	if c.Encrypt {
+		// The envelope-encryption stream can't be re-seeked to resume a
+		// partial upload, so encrypted archives always upload from scratch.
+		canResume = false
+		ek, err := c.envelopeKey()
+		if err != nil {
+			s.Stop()
+			c.UI.Error(err.Error())
+			logger.Error("upload", "error", err.Error())
+			return 1
+		}
+		var encMeta map[string]string
+		body, encMeta, err = encryptReader(reader, ek)
+		if err != nil {
+			s.Stop()
+			c.UI.Error(err.Error())
+			logger.Error("upload", "error", err.Error())
+			return 1
+		}
+		for k, v := range encMeta {
+			metadata[k] = v
+		}
+		fileType = "application/octet-stream"
+	}
+
+	// computedETag is the multipart ETag rover derived for the upload, used
+	// below to verify against the object's remote ETag. The resumable path
+	// derives it from each UploadPart response; the non-resumable path
+	// hashes the stream locally via etagReader.
+	var computedETag string
+	var location string
+	if canResume {
+		statePath := filepath.Join(filepath.Dir(c.ArchiveFile), uploadStateFile)
+		location, computedETag, err = resumable.PutResumable(ctx, PutInput{
+			Key:         path,
+			Size:        fileSize,
+			ContentType: fileType,
+			Metadata:    metadata,
+			SSE:         c.SSE,
+			SSEKMSKeyID: c.KMSKeyID,
+			OnProgress:  onProgress,
+		}, file, statePath)
+	} else {
+		etagReader := newMultipartETagReader(body, c.PartSize)
+		location, err = store.Put(ctx, PutInput{
+			Key:         path,
+			Body:        etagReader,
+			Size:        fileSize,
+			ContentType: fileType,
+			Metadata:    metadata,
+			SSE:         c.SSE,
+			SSEKMSKeyID: c.KMSKeyID,
+		})
+		computedETag = etagReader.ETag()
 	}
 	s.Stop()
+	if err != nil {
+		out := fmt.Sprintf("Error: %s from %s storage!", err, c.Provider)
+		c.UI.Error(out)
+		logger.Error("upload", "error", out)
+		return 1
+	}
+
+	kmsKeyARN := metadata[metaKMSKeyID]
+	if len(kmsKeyARN) == 0 && c.SSE == s3.ServerSideEncryptionAwsKms {
+		kmsKeyARN = c.KMSKeyID
+	}
+	manifest := UploadManifest{
+		Provider:   c.Provider,
+		Key:        path,
+		Location:   location,
+		Size:       fileSize,
+		SHA256:     fingerprint,
+		KMSKeyARN:  kmsKeyARN,
+		UploadedAt: now.UTC().Format(time.RFC3339),
+	}
+	if c.Provider == ProviderS3 || c.Provider == ProviderS3Compat {
+		manifest.Bucket = os.Getenv("AWS_BUCKET")
+	}
+
+	if verifiable, ok := store.(Verifiable); ok {
+		manifest.Region = verifiable.Region()
+		if localETag := computedETag; localETag != "" {
+			manifest.MultipartETag = localETag
+			if remoteETag, verified, verr := verifiable.VerifyETag(ctx, path, localETag); verr != nil {
+				logger.Warn("upload", "verify-error", verr.Error())
+			} else if !verified {
+				out := fmt.Sprintf("Uploaded object's ETag %s does not match the locally computed ETag %s; the archive may be corrupt", remoteETag, localETag)
+				c.UI.Error(out)
+				logger.Error("upload", "error", out)
+				return 1
+			} else {
+				manifest.ETagVerified = true
+			}
+		}
+		if url, perr := verifiable.PresignGet(ctx, path, c.PresignTTL); perr != nil {
+			logger.Warn("upload", "presign-error", perr.Error())
+		} else {
+			manifest.PresignedURL = url
+			manifest.PresignedExpiry = now.Add(c.PresignTTL).UTC().Format(time.RFC3339)
+		}
+	}
+
+	if err := writeManifest(manifest); err != nil {
+		logger.Warn("upload", "manifest-error", err.Error())
+	}
+
+	if c.Output == "json" {
+		b, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			c.UI.Error(fmt.Sprintf("Could not marshal upload manifest: %v", err))
+			return 1
+		}
+		c.UI.Output(string(b))
+	} else {
+		c.UI.Output(fmt.Sprintf("Success! Uploaded to %s", location))
+	}
 
 	return 0
 
 }
 
+// alreadyUploaded reports whether the object Head found at the
+// content-addressed key is this same archive, so Run can skip a redundant
+// upload. path already encodes fingerprint, so a backend like localStorage
+// that has no metadata store to compare against (existingMeta == nil) can
+// still trust a bare key match; a backend with real metadata (s3, gcs,
+// azure) additionally confirms it via metaSHA256.
+func alreadyUploaded(exists bool, existingMeta map[string]string, fingerprint string) bool {
+	return exists && (existingMeta == nil || existingMeta[metaSHA256] == fingerprint)
+}
+
+// validateUploadFlags checks flag combinations Run doesn't otherwise hand
+// off to newStorage or envelopeKey to validate themselves.
+func validateUploadFlags(output string, partSize int64, provider, sse, kmsKeyID string, encrypt bool) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("Invalid -output %q: must be text or json", output)
+	}
+	if partSize <= 0 {
+		return fmt.Errorf("Invalid -part-size %d: must be greater than 0", partSize)
+	}
+	// -kms-key-id is exempted when -encrypt is set: it then names the
+	// client-side envelope key (see envelopeKey), not an SSE-KMS key, and
+	// that path works on every provider.
+	sseRequested := len(sse) > 0 || (len(kmsKeyID) > 0 && !encrypt)
+	if sseRequested && provider != ProviderS3 && provider != ProviderS3Compat {
+		return fmt.Errorf("-sse and -kms-key-id only apply to -provider=s3 or s3compat; -provider=%s would upload without server-side encryption", provider)
+	}
+	return nil
+}
+
+// envelopeKey builds the per-upload data key for -encrypt: wrapped by AWS
+// KMS when -kms-key-id is set, otherwise derived from ROVER_PASSPHRASE via
+// scrypt for offline use.
+func (c *UploadCommand) envelopeKey() (*envelopeKey, error) {
+	if len(c.KMSKeyID) > 0 {
+		return newKMSEnvelopeKey(c.KMSKeyID)
+	}
+	passphrase := os.Getenv("ROVER_PASSPHRASE")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("-encrypt requires -kms-key-id or ROVER_PASSPHRASE to be set")
+	}
+	return newPassphraseEnvelopeKey(passphrase)
+}
+
 // Synopsis output
 func (c *UploadCommand) Synopsis() string {
 	return "Uploads rover archive file to S3 bucket"
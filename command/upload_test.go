@@ -0,0 +1,137 @@
+package command
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAlreadyUploaded(t *testing.T) {
+	cases := []struct {
+		name          string
+		exists        bool
+		existingMeta  map[string]string
+		fingerprint   string
+		wantAlreadyUp bool
+	}{
+		{name: "does not exist", exists: false, wantAlreadyUp: false},
+		{
+			name:          "local backend has no metadata store but the key matched",
+			exists:        true,
+			existingMeta:  nil,
+			fingerprint:   "abc123",
+			wantAlreadyUp: true,
+		},
+		{
+			name:          "s3-style backend confirms via matching sha256 metadata",
+			exists:        true,
+			existingMeta:  map[string]string{metaSHA256: "abc123"},
+			fingerprint:   "abc123",
+			wantAlreadyUp: true,
+		},
+		{
+			name:          "s3-style backend has metadata but it's for a different upload",
+			exists:        true,
+			existingMeta:  map[string]string{metaSHA256: "other"},
+			fingerprint:   "abc123",
+			wantAlreadyUp: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := alreadyUploaded(tc.exists, tc.existingMeta, tc.fingerprint); got != tc.wantAlreadyUp {
+				t.Fatalf("alreadyUploaded() = %v, want %v", got, tc.wantAlreadyUp)
+			}
+		})
+	}
+}
+
+func TestValidateUploadFlags(t *testing.T) {
+	cases := []struct {
+		name      string
+		output    string
+		partSize  int64
+		provider  string
+		sse       string
+		kmsKeyID  string
+		encrypt   bool
+		wantErr   bool
+		wantMatch string
+	}{
+		{
+			name:     "valid s3 defaults",
+			output:   "text",
+			partSize: partSizeDefault,
+			provider: ProviderS3,
+		},
+		{
+			name:      "invalid output",
+			output:    "xml",
+			partSize:  partSizeDefault,
+			provider:  ProviderS3,
+			wantErr:   true,
+			wantMatch: "-output",
+		},
+		{
+			name:      "non-positive part-size",
+			output:    "text",
+			partSize:  0,
+			provider:  ProviderS3,
+			wantErr:   true,
+			wantMatch: "-part-size",
+		},
+		{
+			name:      "sse on a non-s3 provider is rejected",
+			output:    "text",
+			partSize:  partSizeDefault,
+			provider:  ProviderGCS,
+			sse:       "AES256",
+			wantErr:   true,
+			wantMatch: "-sse and -kms-key-id",
+		},
+		{
+			name:      "kms-key-id alone on a non-s3 provider is rejected",
+			output:    "text",
+			partSize:  partSizeDefault,
+			provider:  ProviderAzure,
+			kmsKeyID:  "alias/foo",
+			wantErr:   true,
+			wantMatch: "-sse and -kms-key-id",
+		},
+		{
+			name:     "kms-key-id with -encrypt on a non-s3 provider is the client-side envelope key, not SSE",
+			output:   "text",
+			partSize: partSizeDefault,
+			provider: ProviderGCS,
+			kmsKeyID: "alias/foo",
+			encrypt:  true,
+			wantErr:  false,
+		},
+		{
+			name:     "sse on s3compat is fine",
+			output:   "json",
+			partSize: partSizeDefault,
+			provider: ProviderS3Compat,
+			sse:      "aws:kms",
+			kmsKeyID: "alias/foo",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateUploadFlags(tc.output, tc.partSize, tc.provider, tc.sse, tc.kmsKeyID, tc.encrypt)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("validateUploadFlags() err = nil, want an error")
+				}
+				if tc.wantMatch != "" && !strings.Contains(err.Error(), tc.wantMatch) {
+					t.Fatalf("validateUploadFlags() err = %q, want it to contain %q", err.Error(), tc.wantMatch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateUploadFlags() err = %v, want nil", err)
+			}
+		})
+	}
+}
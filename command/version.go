@@ -0,0 +1,6 @@
+package command
+
+// Version is the rover release recorded in upload metadata so downstream
+// tooling can tell which build captured an archive. Overridden at build
+// time via -ldflags "-X github.com/sun-exploit/rover/command.Version=...".
+var Version = "dev"